@@ -0,0 +1,101 @@
+// Copyright 2023 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiWarningTextMaxLen bounds the length, in bytes, of the "text" label; warn-texts
+// that still differ within their first apiWarningTextMaxLen bytes stay distinct series.
+const apiWarningTextMaxLen = 120
+
+var apiWarningsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "api", "warnings_total"),
+	"Number of times an Elasticsearch API response carried a Warning (deprecation) header, by collector, RFC 7234 warn-code and normalized warn-text",
+	[]string{"collector", "code", "text"}, nil)
+
+// warningHeaderRe parses an RFC 7234 Warning header value, e.g.
+// `299 Elasticsearch-8.11.0 "[ignore_throttled] parameter is deprecated"`.
+var warningHeaderRe = regexp.MustCompile(`^(\d{3})\s+\S+\s+"((?:[^"\\]|\\.)*)"`)
+
+// warningDynamicTokenRe matches the numeric tokens most likely to make otherwise
+// identical warnings collide on cardinality (indices counts, byte sizes, etc).
+var warningDynamicTokenRe = regexp.MustCompile(`\d+`)
+
+type apiWarningKey struct {
+	Collector string
+	Code      string
+	Text      string
+}
+
+var (
+	apiWarningCountsMu sync.Mutex
+	apiWarningCounts   = map[apiWarningKey]uint64{}
+)
+
+// recordAPIWarnings parses any RFC 7234 Warning headers on header and accumulates
+// them into the exporter-wide elasticsearch_api_warnings_total counter, keyed by the
+// calling collector's name so operators can see upcoming API removals before a
+// scrape breaks.
+func recordAPIWarnings(collectorName string, header http.Header) {
+	for _, raw := range header.Values("Warning") {
+		m := warningHeaderRe.FindStringSubmatch(raw)
+		if m == nil {
+			continue
+		}
+		key := apiWarningKey{
+			Collector: collectorName,
+			Code:      m[1],
+			Text:      normalizeWarningText(m[2]),
+		}
+
+		apiWarningCountsMu.Lock()
+		apiWarningCounts[key]++
+		apiWarningCountsMu.Unlock()
+	}
+}
+
+// normalizeWarningText replaces each run of digits in a warn-text with "#" and truncates
+// it, so recurring warnings that differ only in numbers share one series. Other dynamic
+// tokens, such as index or setting names, are kept as they are.
+func normalizeWarningText(text string) string {
+	text = warningDynamicTokenRe.ReplaceAllString(text, "#")
+	if len(text) > apiWarningTextMaxLen {
+		text = text[:apiWarningTextMaxLen] + "..."
+	}
+	return text
+}
+
+// collectAPIWarningMetrics emits the current elasticsearch_api_warnings_total series.
+// It emits the accumulated totals of every collector, not only the caller's, so it is
+// called from a single place per scrape (TaskCollector.Update); a second caller in the
+// same scrape would emit duplicate series.
+func collectAPIWarningMetrics(ch chan<- prometheus.Metric) {
+	apiWarningCountsMu.Lock()
+	defer apiWarningCountsMu.Unlock()
+
+	for key, count := range apiWarningCounts {
+		ch <- prometheus.MustNewConstMetric(
+			apiWarningsDesc,
+			prometheus.CounterValue,
+			float64(count),
+			key.Collector, key.Code, key.Text,
+		)
+	}
+}
@@ -20,74 +20,221 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
 )
 
-// filterByTask global required because collector interface doesn't expose any way to take
-// constructor args.
-var actionFilter string
+// taskFilters holds the name=pattern pairs registered via repeated --tasks.filter
+// flags, e.g. --tasks.filter=bulk=indices:data/write/bulk. Each entry results in its
+// own _tasks request, scraped in parallel, so its own elasticsearch_task_stats_action_total
+// series carrying the filter name as a label.
+var taskFilters = map[string]string{}
+
+const defaultTaskFilterName = "default"
+
+// taskRunningTimeBuckets covers tasks from 10ms up to ~10 minutes, which spans the
+// vast majority of task durations seen on a healthy cluster while still bucketing
+// the runaway indices:* tasks operators care about.
+var taskRunningTimeBuckets = prometheus.ExponentialBuckets(0.01, 2, 17)
 
 var taskActionDesc = prometheus.NewDesc(
 	prometheus.BuildFQName(namespace, "task_stats", "action_total"),
-	"Number of tasks of a certain action",
-	[]string{"action"}, nil)
+	"Number of tasks of a certain action, node and type",
+	[]string{"filter", "action", "node", "type"}, nil)
+
+var taskRunningTimeDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "task_stats", "running_time_seconds"),
+	"Histogram of task running time in seconds",
+	[]string{"filter"}, nil)
+
+var taskCancellableDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "task_stats", "cancellable"),
+	"Number of tasks that are cancellable",
+	[]string{"filter"}, nil)
+
+var taskCancelledDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "task_stats", "cancelled"),
+	"Number of currently listed tasks that have been cancelled",
+	[]string{"filter"}, nil)
+
+var taskChildrenDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "task_stats", "children_total"),
+	"Number of child tasks of a given action spawned by a parent action",
+	[]string{"filter", "parent_action", "child_action"}, nil)
+
+var taskTreeDepthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "task_stats", "tree_depth"),
+	"Maximum depth of the task tree rooted at a given action",
+	[]string{"filter", "action"}, nil)
+
+// taskGroupBy is the package-level default for the "tasks.group-by" flag, copied
+// onto each TaskCollector at construction time. It is not read afterwards, so that
+// the collector (like its filters) carries its own config rather than reaching back
+// into global state.
+var taskGroupBy string
 
 func init() {
-	kingpin.Flag("tasks.actions",
-		"Filter on task actions. Used in same way as Task API actions param").
-		Default("indices:*").StringVar(&actionFilter)
+	kingpin.Flag("tasks.filter",
+		"Filter on task actions, as name=pattern pairs (e.g. --tasks.filter=bulk=indices:data/write/bulk). "+
+			"Repeat to scrape several independent filters, each producing its own metric series. "+
+			"Defaults to a single filter named \"default\" matching indices:*.").
+		StringMapVar(&taskFilters)
+	kingpin.Flag("tasks.group-by",
+		"Group tasks by. Set to 'parents' to additionally collect parent/child task tree metrics").
+		Default("none").EnumVar(&taskGroupBy, "none", "parents")
 	registerCollector("tasks", defaultDisabled, NewTaskCollector)
 }
 
 // Task Information Struct
 type TaskCollector struct {
-	logger log.Logger
-	hc     *http.Client
-	u      *url.URL
+	logger  log.Logger
+	hc      *http.Client
+	u       *url.URL
+	filters map[string]string
+	groupBy string
 }
 
 // NewTaskCollector defines Task Prometheus metrics
 func NewTaskCollector(logger log.Logger, u *url.URL, hc *http.Client) (Collector, error) {
+	filters := taskFilters
+	if len(filters) == 0 {
+		filters = map[string]string{defaultTaskFilterName: "indices:*"}
+	}
+
 	level.Info(logger).Log("msg", "task collector created",
-		"actionFilter", actionFilter,
+		"filters", fmt.Sprintf("%v", filters),
+		"groupBy", taskGroupBy,
 	)
 
 	return &TaskCollector{
-		logger: logger,
-		hc:     hc,
-		u:      u,
+		logger:  logger,
+		hc:      hc,
+		u:       u,
+		filters: filters,
+		groupBy: taskGroupBy,
 	}, nil
 }
 
 func (t *TaskCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
-	stats, err := t.fetchAndDecodeAndAggregateTaskStats()
+	results, err := t.fetchAndDecodeAndAggregateTaskStatsForAllFilters(ctx)
 	if err != nil {
-		err = fmt.Errorf("failed to fetch and decode task stats: %w", err)
-		return err
+		return fmt.Errorf("failed to fetch and decode task stats: %w", err)
 	}
-	for action, count := range stats.CountByAction {
+
+	for _, result := range results {
+		for key, count := range result.stats.CountByAction {
+			ch <- prometheus.MustNewConstMetric(
+				taskActionDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				result.filter, key.Action, key.Node, key.Type,
+			)
+		}
+		ch <- prometheus.MustNewConstHistogram(
+			taskRunningTimeDesc,
+			result.stats.RunningTime.Count,
+			result.stats.RunningTime.Sum,
+			result.stats.RunningTime.Buckets,
+			result.filter,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			taskCancellableDesc,
+			prometheus.GaugeValue,
+			float64(result.stats.CancellableCount),
+			result.filter,
+		)
 		ch <- prometheus.MustNewConstMetric(
-			taskActionDesc,
+			taskCancelledDesc,
 			prometheus.GaugeValue,
-			float64(count),
-			action,
+			float64(result.stats.CancelledCount),
+			result.filter,
 		)
 	}
+	collectAPIWarningMetrics(ch)
+
+	if t.groupBy == "parents" {
+		treeResults, err := t.fetchAndDecodeAndAggregateTaskTreeForAllFilters(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch and decode task tree stats: %w", err)
+		}
+		for _, treeResult := range treeResults {
+			for key, count := range treeResult.stats.ChildrenByParentAction {
+				ch <- prometheus.MustNewConstMetric(
+					taskChildrenDesc,
+					prometheus.GaugeValue,
+					float64(count),
+					treeResult.filter, key.ParentAction, key.ChildAction,
+				)
+			}
+			for action, depth := range treeResult.stats.DepthByRootAction {
+				ch <- prometheus.MustNewConstMetric(
+					taskTreeDepthDesc,
+					prometheus.GaugeValue,
+					float64(depth),
+					treeResult.filter, action,
+				)
+			}
+		}
+	}
 	return nil
 }
 
-func (t *TaskCollector) fetchAndDecodeAndAggregateTaskStats() (*AggregatedTaskStats, error) {
+// taskFilterResult is the outcome of scraping _tasks for a single configured filter.
+type taskFilterResult struct {
+	filter string
+	stats  *AggregatedTaskStats
+}
+
+// fetchAndDecodeAndAggregateTaskStatsForAllFilters issues one _tasks request per
+// configured filter, in parallel, and returns one result per filter.
+func (t *TaskCollector) fetchAndDecodeAndAggregateTaskStatsForAllFilters(ctx context.Context) ([]taskFilterResult, error) {
+	names := make([]string, 0, len(t.filters))
+	for name := range t.filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]taskFilterResult, len(names))
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, name := range names {
+		i, name := i, name
+		pattern := t.filters[name]
+		g.Go(func() error {
+			stats, err := t.fetchAndDecodeAndAggregateTaskStats(gCtx, pattern)
+			if err != nil {
+				return fmt.Errorf("failed to fetch task stats for filter %q: %w", name, err)
+			}
+			results[i] = taskFilterResult{filter: name, stats: stats}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (t *TaskCollector) fetchAndDecodeAndAggregateTaskStats(ctx context.Context, actions string) (*AggregatedTaskStats, error) {
 	u := t.u.ResolveReference(&url.URL{Path: "_tasks"})
 	q := u.Query()
+	// group_by=none is kept intentionally: it returns a flat "tasks" array rather than
+	// the node-nested shape of the default grouping, which is what AggregateTasksStream
+	// parses. It does not drop the per-task node/type breakdown added above - the flat
+	// list already carries "node" and "type" on every task.
 	q.Set("group_by", "none")
-	q.Set("actions", actionFilter)
+	q.Set("actions", actions)
 	u.RawQuery = q.Encode()
 
-	res, err := t.hc.Get(u.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.hc.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get data stream stats health from %s://%s:%s%s: %s",
 			u.Scheme, u.Hostname(), u.Port(), u.Path, err)
@@ -107,18 +254,97 @@ func (t *TaskCollector) fetchAndDecodeAndAggregateTaskStats() (*AggregatedTaskSt
 		return nil, fmt.Errorf("HTTP Request to %v failed with code %d", u.String(), res.StatusCode)
 	}
 
+	recordAPIWarnings("tasks", res.Header)
+
+	stats, err := AggregateTasksStream(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// taskTreeFilterResult is the outcome of scraping the group_by=parents tree for a
+// single configured filter.
+type taskTreeFilterResult struct {
+	filter string
+	stats  *AggregatedTaskTreeStats
+}
+
+// fetchAndDecodeAndAggregateTaskTreeForAllFilters issues one group_by=parents
+// request per configured filter, in parallel, and returns one result per filter -
+// so that adding a second --tasks.filter doesn't silently shrink what the tree
+// metrics cover.
+func (t *TaskCollector) fetchAndDecodeAndAggregateTaskTreeForAllFilters(ctx context.Context) ([]taskTreeFilterResult, error) {
+	names := make([]string, 0, len(t.filters))
+	for name := range t.filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]taskTreeFilterResult, len(names))
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, name := range names {
+		i, name := i, name
+		pattern := t.filters[name]
+		g.Go(func() error {
+			stats, err := t.fetchAndDecodeAndAggregateTaskTree(gCtx, pattern)
+			if err != nil {
+				return fmt.Errorf("failed to fetch task tree for filter %q: %w", name, err)
+			}
+			results[i] = taskTreeFilterResult{filter: name, stats: stats}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (t *TaskCollector) fetchAndDecodeAndAggregateTaskTree(ctx context.Context, actions string) (*AggregatedTaskTreeStats, error) {
+	u := t.u.ResolveReference(&url.URL{Path: "_tasks"})
+	q := u.Query()
+	q.Set("group_by", "parents")
+	q.Set("actions", actions)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task tree from %s://%s:%s%s: %s",
+			u.Scheme, u.Hostname(), u.Port(), u.Path, err)
+	}
+
+	defer func() {
+		err = res.Body.Close()
+		if err != nil {
+			level.Warn(t.logger).Log(
+				"msg", "failed to close http.Client",
+				"err", err,
+			)
+		}
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Request to %v failed with code %d", u.String(), res.StatusCode)
+	}
+
+	recordAPIWarnings("tasks", res.Header)
+
 	bts, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	var tr TasksResponse
+	var tr TasksByParentResponse
 	if err := json.Unmarshal(bts, &tr); err != nil {
 		return nil, err
 	}
 
-	stats := AggregateTasks(tr)
-	return stats, nil
+	return AggregateTaskTree(tr), nil
 }
 
 // TasksResponse is a representation of the Task management API.
@@ -130,18 +356,209 @@ type TasksResponse struct {
 //
 // We only parse a very limited amount of this API for use in aggregation.
 type TaskResponse struct {
-	Action string `json:"action"`
+	Action             string `json:"action"`
+	Node               string `json:"node"`
+	Type               string `json:"type"`
+	StartTimeInMillis  int64  `json:"start_time_in_millis"`
+	RunningTimeInNanos int64  `json:"running_time_in_nanos"`
+	Cancellable        bool   `json:"cancellable"`
+	Cancelled          bool   `json:"cancelled"`
+}
+
+// taskActionKey identifies one elasticsearch_task_stats_action_total series.
+type taskActionKey struct {
+	Action string
+	Node   string
+	Type   string
+}
+
+// taskHistogram accumulates observations into cumulative bucket counts suitable
+// for prometheus.MustNewConstHistogram.
+type taskHistogram struct {
+	Buckets map[float64]uint64
+	Count   uint64
+	Sum     float64
+}
+
+func newTaskHistogram(bounds []float64) *taskHistogram {
+	buckets := make(map[float64]uint64, len(bounds))
+	for _, bound := range bounds {
+		buckets[bound] = 0
+	}
+	return &taskHistogram{Buckets: buckets}
+}
+
+func (h *taskHistogram) Observe(seconds float64) {
+	h.Count++
+	h.Sum += seconds
+	for bound := range h.Buckets {
+		if seconds <= bound {
+			h.Buckets[bound]++
+		}
+	}
 }
 
 type AggregatedTaskStats struct {
-	CountByAction map[string]int64
+	CountByAction    map[taskActionKey]int64
+	RunningTime      *taskHistogram
+	CancellableCount int64
+	CancelledCount   int64
 }
 
 func AggregateTasks(t TasksResponse) *AggregatedTaskStats {
-	actions := map[string]int64{}
+	actions := map[taskActionKey]int64{}
+	runningTime := newTaskHistogram(taskRunningTimeBuckets)
+	var cancellableCount, cancelledCount int64
 	for _, task := range t.Tasks {
-		actions[task.Action] += 1
+		actions[taskActionKey{Action: task.Action, Node: task.Node, Type: task.Type}] += 1
+		runningTime.Observe(float64(task.RunningTimeInNanos) / 1e9)
+		if task.Cancellable {
+			cancellableCount++
+		}
+		if task.Cancelled {
+			cancelledCount++
+		}
+	}
+	agg := &AggregatedTaskStats{
+		CountByAction:    actions,
+		RunningTime:      runningTime,
+		CancellableCount: cancellableCount,
+		CancelledCount:   cancelledCount,
 	}
-	agg := &AggregatedTaskStats{CountByAction: actions}
 	return agg
 }
+
+// AggregateTasksStream aggregates the same "tasks" array as AggregateTasks, but reads
+// and decodes r token-by-token instead of buffering the whole response, so a 100k-task
+// response can be scraped with bounded memory.
+func AggregateTasksStream(r io.Reader) (*AggregatedTaskStats, error) {
+	dec := json.NewDecoder(r)
+	actions := map[taskActionKey]int64{}
+	runningTime := newTaskHistogram(taskRunningTimeBuckets)
+	var cancellableCount, cancelledCount int64
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := keyTok.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected tasks response object key, got %v", keyTok)
+		}
+
+		if key != "tasks" {
+			var discard json.RawMessage
+			if err := dec.Decode(&discard); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, err
+		}
+
+		var task TaskResponse
+		for dec.More() {
+			task = TaskResponse{}
+			if err := dec.Decode(&task); err != nil {
+				return nil, err
+			}
+			actions[taskActionKey{Action: task.Action, Node: task.Node, Type: task.Type}] += 1
+			runningTime.Observe(float64(task.RunningTimeInNanos) / 1e9)
+			if task.Cancellable {
+				cancellableCount++
+			}
+			if task.Cancelled {
+				cancelledCount++
+			}
+		}
+		if _, err := dec.Token(); err != nil { // consume the closing ']'
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil { // consume the closing '}'
+		return nil, err
+	}
+
+	return &AggregatedTaskStats{
+		CountByAction:    actions,
+		RunningTime:      runningTime,
+		CancellableCount: cancellableCount,
+		CancelledCount:   cancelledCount,
+	}, nil
+}
+
+// expectDelim reads the next JSON token from dec and errors unless it is the delimiter d.
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	got, ok := tok.(json.Delim)
+	if !ok || got != d {
+		return fmt.Errorf("expected %q, got %v", d, tok)
+	}
+	return nil
+}
+
+// TasksByParentResponse is a representation of the Task management API when queried
+// with group_by=parents: root tasks (those with no parent) are keyed by task id, with
+// their descendants nested recursively under "children".
+type TasksByParentResponse struct {
+	Tasks map[string]TaskNode `json:"tasks"`
+}
+
+// TaskNode is a single node in the parent/child task tree returned by group_by=parents.
+//
+// We only parse the fields needed to aggregate fan-out across the tree.
+type TaskNode struct {
+	Action   string     `json:"action"`
+	Node     string     `json:"node"`
+	Type     string     `json:"type"`
+	Children []TaskNode `json:"children"`
+}
+
+// taskParentChildKey identifies one elasticsearch_task_stats_children_total series.
+type taskParentChildKey struct {
+	ParentAction string
+	ChildAction  string
+}
+
+type AggregatedTaskTreeStats struct {
+	ChildrenByParentAction map[taskParentChildKey]int64
+	DepthByRootAction      map[string]int64
+}
+
+func AggregateTaskTree(t TasksByParentResponse) *AggregatedTaskTreeStats {
+	stats := &AggregatedTaskTreeStats{
+		ChildrenByParentAction: map[taskParentChildKey]int64{},
+		DepthByRootAction:      map[string]int64{},
+	}
+	for _, root := range t.Tasks {
+		depth := walkTaskNode(root, stats)
+		if cur, ok := stats.DepthByRootAction[root.Action]; !ok || depth > cur {
+			stats.DepthByRootAction[root.Action] = depth
+		}
+	}
+	return stats
+}
+
+// walkTaskNode depth-first walks node's descendants, recording each parent/child
+// action pair and returning the depth of the deepest descendant below node (0 if
+// node is a leaf).
+func walkTaskNode(node TaskNode, stats *AggregatedTaskTreeStats) int64 {
+	var maxChildDepth int64
+	for _, child := range node.Children {
+		stats.ChildrenByParentAction[taskParentChildKey{ParentAction: node.Action, ChildAction: child.Action}]++
+		if childDepth := walkTaskNode(child, stats); childDepth+1 > maxChildDepth {
+			maxChildDepth = childDepth + 1
+		}
+	}
+	return maxChildDepth
+}
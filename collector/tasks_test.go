@@ -0,0 +1,216 @@
+// Copyright 2023 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const tasksStreamTestJSON = `{
+	"nodes": {"ignored": "field, present before \"tasks\" to exercise the skip path"},
+	"tasks": [
+		{"action": "indices:data/write/bulk", "node": "node-1", "type": "transport", "running_time_in_nanos": 500000000, "cancellable": false, "cancelled": false},
+		{"action": "indices:data/write/bulk", "node": "node-1", "type": "transport", "running_time_in_nanos": 1500000000, "cancellable": true, "cancelled": false},
+		{"action": "indices:data/read/search", "node": "node-2", "type": "direct", "running_time_in_nanos": 20000000000, "cancellable": true, "cancelled": true}
+	],
+	"trailer": "also ignored, present after \"tasks\" to exercise the skip path"
+}`
+
+func TestAggregateTasksStreamMatchesAggregateTasks(t *testing.T) {
+	var tr TasksResponse
+	if err := json.Unmarshal([]byte(tasksStreamTestJSON), &tr); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	want := AggregateTasks(tr)
+	got, err := AggregateTasksStream(strings.NewReader(tasksStreamTestJSON))
+	if err != nil {
+		t.Fatalf("AggregateTasksStream: %v", err)
+	}
+
+	if !reflect.DeepEqual(want.CountByAction, got.CountByAction) {
+		t.Errorf("CountByAction mismatch:\n buffered: %+v\n streamed: %+v", want.CountByAction, got.CountByAction)
+	}
+	if want.CancellableCount != got.CancellableCount {
+		t.Errorf("CancellableCount = %d, want %d", got.CancellableCount, want.CancellableCount)
+	}
+	if want.CancelledCount != got.CancelledCount {
+		t.Errorf("CancelledCount = %d, want %d", got.CancelledCount, want.CancelledCount)
+	}
+	if want.RunningTime.Count != got.RunningTime.Count || want.RunningTime.Sum != got.RunningTime.Sum {
+		t.Errorf("RunningTime = {Count: %d, Sum: %f}, want {Count: %d, Sum: %f}",
+			got.RunningTime.Count, got.RunningTime.Sum, want.RunningTime.Count, want.RunningTime.Sum)
+	}
+	if !reflect.DeepEqual(want.RunningTime.Buckets, got.RunningTime.Buckets) {
+		t.Errorf("RunningTime.Buckets mismatch:\n buffered: %+v\n streamed: %+v", want.RunningTime.Buckets, got.RunningTime.Buckets)
+	}
+}
+
+func TestAggregateTasksStreamCounts(t *testing.T) {
+	got, err := AggregateTasksStream(strings.NewReader(tasksStreamTestJSON))
+	if err != nil {
+		t.Fatalf("AggregateTasksStream: %v", err)
+	}
+
+	wantCount := taskActionKey{Action: "indices:data/write/bulk", Node: "node-1", Type: "transport"}
+	if got.CountByAction[wantCount] != 2 {
+		t.Errorf("CountByAction[%+v] = %d, want 2", wantCount, got.CountByAction[wantCount])
+	}
+	if got.CancellableCount != 2 {
+		t.Errorf("CancellableCount = %d, want 2", got.CancellableCount)
+	}
+	if got.CancelledCount != 1 {
+		t.Errorf("CancelledCount = %d, want 1", got.CancelledCount)
+	}
+}
+
+func TestTaskHistogramObserve(t *testing.T) {
+	h := newTaskHistogram([]float64{0.01, 1, 10})
+	for _, seconds := range []float64{0.005, 0.5, 5, 50} {
+		h.Observe(seconds)
+	}
+
+	if h.Count != 4 {
+		t.Fatalf("Count = %d, want 4", h.Count)
+	}
+	if h.Sum != 0.005+0.5+5+50 {
+		t.Fatalf("Sum = %v, want %v", h.Sum, 0.005+0.5+5+50)
+	}
+
+	// Buckets are cumulative: le=0.01 only counts the 0.005s observation, le=1
+	// additionally picks up 0.5s, le=10 additionally picks up 5s, and the 50s
+	// observation never falls within any configured bound.
+	want := map[float64]uint64{0.01: 1, 1: 2, 10: 3}
+	if !reflect.DeepEqual(h.Buckets, want) {
+		t.Errorf("Buckets = %+v, want %+v", h.Buckets, want)
+	}
+}
+
+func TestAggregateTaskTree(t *testing.T) {
+	const treeJSON = `{
+		"tasks": {
+			"node-1:1": {
+				"action": "indices:data/write/bulk",
+				"node": "node-1",
+				"type": "transport",
+				"children": [
+					{
+						"action": "indices:data/write/bulk[s]",
+						"node": "node-1",
+						"type": "direct",
+						"children": [
+							{"action": "indices:data/write/bulk[s][p]", "node": "node-2", "type": "direct"}
+						]
+					},
+					{"action": "indices:data/write/bulk[s]", "node": "node-3", "type": "direct"}
+				]
+			},
+			"node-2:7": {
+				"action": "indices:data/read/search",
+				"node": "node-2",
+				"type": "transport"
+			}
+		}
+	}`
+
+	var tr TasksByParentResponse
+	if err := json.Unmarshal([]byte(treeJSON), &tr); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	stats := AggregateTaskTree(tr)
+
+	wantChildren := map[taskParentChildKey]int64{
+		{ParentAction: "indices:data/write/bulk", ChildAction: "indices:data/write/bulk[s]"}:       2,
+		{ParentAction: "indices:data/write/bulk[s]", ChildAction: "indices:data/write/bulk[s][p]"}: 1,
+	}
+	if !reflect.DeepEqual(stats.ChildrenByParentAction, wantChildren) {
+		t.Errorf("ChildrenByParentAction = %+v, want %+v", stats.ChildrenByParentAction, wantChildren)
+	}
+
+	wantDepth := map[string]int64{
+		"indices:data/write/bulk":  2,
+		"indices:data/read/search": 0,
+	}
+	if !reflect.DeepEqual(stats.DepthByRootAction, wantDepth) {
+		t.Errorf("DepthByRootAction = %+v, want %+v", stats.DepthByRootAction, wantDepth)
+	}
+}
+
+func TestNormalizeWarningText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "collapses dynamic numbers so similar warnings share a series",
+			in:   "[299 docs] in [12] indices matched the deprecated pattern",
+			want: "[# docs] in [#] indices matched the deprecated pattern",
+		},
+		{
+			name: "leaves short, number-free text untouched",
+			in:   "[ignore_throttled] parameter is deprecated",
+			want: "[ignore_throttled] parameter is deprecated",
+		},
+		{
+			name: "truncates text longer than the configured max",
+			in:   strings.Repeat("a", apiWarningTextMaxLen+50),
+			want: strings.Repeat("a", apiWarningTextMaxLen) + "...",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeWarningText(tc.in); got != tc.want {
+				t.Errorf("normalizeWarningText(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRecordAPIWarnings(t *testing.T) {
+	const collectorName = "tasks_test.TestRecordAPIWarnings"
+
+	header := http.Header{}
+	header.Add("Warning", `299 Elasticsearch-8.11.0 "[ignore_throttled] parameter is deprecated"`)
+	header.Add("Warning", `299 Elasticsearch-8.11.0 "[ignore_throttled] parameter is deprecated"`)
+	header.Add("Warning", `299 Elasticsearch-8.11.0 "[12] shards failed during the request"`)
+	header.Add("Warning", "not a well-formed warning header, should be ignored")
+
+	recordAPIWarnings(collectorName, header)
+
+	apiWarningCountsMu.Lock()
+	defer apiWarningCountsMu.Unlock()
+
+	dup := apiWarningKey{Collector: collectorName, Code: "299", Text: "[ignore_throttled] parameter is deprecated"}
+	if got := apiWarningCounts[dup]; got != 2 {
+		t.Errorf("apiWarningCounts[%+v] = %d, want 2", dup, got)
+	}
+
+	distinct := apiWarningKey{Collector: collectorName, Code: "299", Text: "[#] shards failed during the request"}
+	if got := apiWarningCounts[distinct]; got != 1 {
+		t.Errorf("apiWarningCounts[%+v] = %d, want 1 (a distinct warning must not be swallowed by dedup)", distinct, got)
+	}
+
+	for key := range apiWarningCounts {
+		if key.Collector == collectorName && key != dup && key != distinct {
+			t.Errorf("unexpected extra warning series recorded: %+v", key)
+		}
+	}
+}